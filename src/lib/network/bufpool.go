@@ -0,0 +1,38 @@
+// 按2的幂次分桶的字节切片缓存池
+package network
+
+import "sync"
+
+// bufBuckets 是池里各档的缓冲区大小，从64字节到MaxMessageLen(1024默认值)的量级
+var bufBuckets = []int{64, 256, 1024, 4096, 16384, 65536}
+
+// bufPool 把 []byte 按大小分桶缓存，避免每次读消息都重新分配
+type bufPool struct {
+	pools []sync.Pool
+}
+
+func newBufPool() *bufPool {
+	bp := &bufPool{pools: make([]sync.Pool, len(bufBuckets))}
+	for i := range bufBuckets {
+		size := bufBuckets[i]
+		bp.pools[i].New = func() interface{} {
+			return make([]byte, size)
+		}
+	}
+	return bp
+}
+
+// Get 取出一个长度恰好为n的切片，以及用完后归还给池的 Release 函数。
+// 当n超过最大的桶时，直接分配一块不回收的内存。
+func (bp *bufPool) Get(n uint32) (buf []byte, release func()) {
+	for i, size := range bufBuckets {
+		if uint32(size) >= n {
+			pool := &bp.pools[i]
+			b := pool.Get().([]byte)
+			return b[:n], func() {
+				pool.Put(b)
+			}
+		}
+	}
+	return make([]byte, n), func() {}
+}
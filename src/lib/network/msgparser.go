@@ -4,24 +4,44 @@ package network
 import (
 	"encoding/binary"
 	"errors"
-	"io"
 	"math"
+	"sync"
 )
 
 /*
 	在网络中传输的消息格式
-	----------------------
-	| len | id | message |
-	----------------------
-	其中len默认为两个字节(1,2,4字节)，len和id(uint16)默认使用网络字节序
+	-------------------------
+	| len | msgID | message |
+	-------------------------
+	其中len默认为两个字节(1,2,4字节)，msgID默认为两个字节(1,2,4字节)，
+	len和msgID默认使用网络字节序。EncodeFunc/DecodeFunc是对msgID+message
+	整体生效的——Write把msgID和message拼好之后才编码，Read也要整体解码
+	之后才能从里面切出msgID，msgID本身不在编码范围之外单独传输。
 */
 
+// EncodeFunc 在写入长度前对msgID+消息体整体做一次编码（压缩/加密/加校验等）
+type EncodeFunc func([]byte) ([]byte, error)
+
+// DecodeFunc 在切出msgID、校验长度前对msgID+消息体整体做一次解码，与 EncodeFunc 对应。
+// 约定：返回的切片不能别名（alias）传入的data——Read在调用DecodeFunc后立即
+// 把data所在的pool缓冲区release掉，如果返回值仍引用这块内存，缓冲区被其他
+// 连接的Read复用后会悄悄改写调用方正在处理的消息体。
+type DecodeFunc func([]byte) ([]byte, error)
+
 // 解析器维护的数据结构
 type MessageParser struct {
-	MessageLen    int    // 用来存储数据长度所占的空间：1,2,4字节，defalut=2
-	MaxMessageLen uint32 // 数据最大长度
-	MinMessageLen uint32 // 数据最小长度
-	LittleEndian  bool   // 大小端（网络字节序都是大端模式，x86架构的主机都是小端模式）
+	MessageLen    int              // 用来存储数据长度所占的空间：1,2,4字节，defalut=2
+	MsgIDLen      int              // 用来存储msgID所占的空间：1,2,4字节，default=2
+	MaxMessageLen uint32           // 数据最大长度
+	MinMessageLen uint32           // 数据最小长度
+	ByteOrder     binary.ByteOrder // 长度、msgID字段使用的字节序，默认网络字节序(大端)
+	RingSize      int              // 每个连接的环形读缓冲区容量
+
+	EncodeFunc EncodeFunc // 可选：Write/WriteWs 发送前对msgID+消息体整体做的编码，nil表示不处理
+	DecodeFunc DecodeFunc // 可选：Read/ReadWs 读取后对msgID+消息体整体做的解码，nil表示不处理
+
+	pool  *bufPool // Read用的分桶缓冲区池，避免每条消息都make一次
+	rings sync.Map // *Conn -> *RingBuffer，为每个连接维护各自的读缓冲
 }
 
 // 构建一个消息解析器
@@ -29,12 +49,47 @@ type MessageParser struct {
 func NewMessageParser() *MessageParser {
 	newMsg := new(MessageParser)
 	newMsg.MessageLen = 2
+	newMsg.MsgIDLen = 2
 	newMsg.MinMessageLen = 1
 	newMsg.MaxMessageLen = 1024
-	newMsg.LittleEndian = false
+	newMsg.ByteOrder = binary.BigEndian
+	newMsg.RingSize = 4096
+	newMsg.pool = newBufPool()
 	return newMsg
 }
 
+// ring 返回conn对应的环形读缓冲区，懒加载并按连接缓存；首次访问时
+// 额外起一个协程持续把socket里的数据灌进去，供Read按帧消费
+func (msgParser *MessageParser) ring(conn *Conn) *RingBuffer {
+	if v, ok := msgParser.rings.Load(conn); ok {
+		return v.(*RingBuffer)
+	}
+	rb := NewRingBuffer(msgParser.RingSize)
+	msgParser.rings.Store(conn, rb)
+	go msgParser.fill(conn, rb)
+	return rb
+}
+
+// fill 不断把conn里的数据读进rb，直到出错（含EOF）为止，随后关闭rb唤醒阻塞的读者，
+// 并把rb从rings里摘掉，避免连接断开后缓冲区一直留在map里造成泄漏
+func (msgParser *MessageParser) fill(conn *Conn, rb *RingBuffer) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, werr := rb.Write(buf[:n]); werr != nil {
+				msgParser.rings.Delete(conn)
+				return
+			}
+		}
+		if err != nil {
+			rb.Close()
+			msgParser.rings.Delete(conn)
+			return
+		}
+	}
+}
+
 // 设置参数
 func (msgParser *MessageParser) SetMsgLen(MessageLen int, MaxMessageLen uint32, MinMessageLen uint32) {
 	if MessageLen == 1 || MessageLen == 2 || MessageLen == 4 {
@@ -65,170 +120,204 @@ func (msgParser *MessageParser) SetMsgLen(MessageLen int, MaxMessageLen uint32,
 	}
 }
 
-// tcp读取消息
-// 通过len将id+message读取出来
-func (msgParser *MessageParser) Read(conn *Conn) ([]byte, error) {
-	var b [4]byte
-	// 先获取id+msg的长度
-	bufMsgLen := b[:msgParser.MessageLen]
-	if _, err := io.ReadFull(conn, bufMsgLen); err != nil {
-		return nil, err
-	}
-	// 解析长度数据
-	var msgLen uint32
-	switch msgParser.MessageLen {
-	// 单字节不需要处理大小端模式
+// SetMsgIDLen 设置msgID字段所占的字节数：1,2,4，非法值时回退到2
+func (msgParser *MessageParser) SetMsgIDLen(msgIDLen int) {
+	if msgIDLen == 1 || msgIDLen == 2 || msgIDLen == 4 {
+		msgParser.MsgIDLen = msgIDLen
+	} else {
+		msgParser.MsgIDLen = 2
+	}
+}
+
+// readUint 按给定宽度(1/2/4字节)和 ByteOrder 解析一个定长整数字段，
+// len和msgID共用这一套解析逻辑
+func (msgParser *MessageParser) readUint(buf []byte, width int) uint32 {
+	switch width {
 	case 1:
-		msgLen = uint32(bufMsgLen[0])
-	// 多字节需要处理大小端模式
-	case 2:
-		if msgParser.LittleEndian {
-			msgLen = uint32(binary.LittleEndian.Uint16(bufMsgLen))
-		} else {
-			msgLen = uint32(binary.BigEndian.Uint16(bufMsgLen))
-		}
+		return uint32(buf[0])
 	case 4:
-		if msgParser.LittleEndian {
-			msgLen = binary.LittleEndian.Uint32(bufMsgLen)
-		} else {
-			msgLen = binary.BigEndian.Uint32(bufMsgLen)
+		return msgParser.ByteOrder.Uint32(buf)
+	default:
+		return uint32(msgParser.ByteOrder.Uint16(buf))
+	}
+}
+
+// writeUint 是 readUint 的逆操作
+func (msgParser *MessageParser) writeUint(buf []byte, width int, n uint32) {
+	switch width {
+	case 1:
+		buf[0] = byte(n)
+	case 4:
+		msgParser.ByteOrder.PutUint32(buf, n)
+	default:
+		msgParser.ByteOrder.PutUint16(buf, uint16(n))
+	}
+}
+
+// tcp读取消息
+// 通过len将msgID+message读取出来。底层由每个连接各自的RingBuffer提供数据，
+// 半帧到达时在这里阻塞等待，不需要针对socket发起一次性的阻塞读。
+// 返回的release应在调用方用完body后调用，以便把底层缓冲区归还给池；
+// 不调用也不会出错，只是这块缓冲区不会回到池里，改由GC回收。
+func (msgParser *MessageParser) Read(conn *Conn) (msgID uint16, body []byte, release func(), err error) {
+	rb := msgParser.ring(conn)
+	bufMsgLen, err := rb.Peek(msgParser.MessageLen)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgLen := msgParser.readUint(bufMsgLen, msgParser.MessageLen)
+	// 这里只拒绝这个环形缓冲区天生装不下的帧：RingBuffer容量固定，一旦
+	// msgLen隐含的帧装不下这个环，ReadFrame会因为count永远追不上n而
+	// 永久阻塞，fill()也会因为写不进去而一起卡死。msgLen是编码后（on-wire）
+	// 的长度，EncodeFunc/DecodeFunc可能带来额外开销（校验和、IV等），所以
+	// 不能拿它去套用针对明文的MaxMessageLen——那个检查留到解码之后再做。
+	frameLen := msgParser.MessageLen + int(msgLen)
+	if frameLen > rb.Cap() {
+		rb.Discard(msgParser.MessageLen)
+		return 0, nil, nil, errors.New("message too long")
+	}
+	// ReadFrame连同长度前缀一并取出并消费掉，frame反映的是编码后（on-wire）的长度
+	frame, err := rb.ReadFrame(frameLen)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	// frame有可能是环形缓冲区里的别名切片，后续Write会复用这段内存，
+	// 这里立刻拷贝进池里的缓冲区，交给调用方独占使用
+	buf, release := msgParser.pool.Get(msgLen)
+	copy(buf, frame[msgParser.MessageLen:])
+	// Write把msgID和body拼在一起后整体交给EncodeFunc编码，所以这里也要整体
+	// 解码之后才能切出msgID，不能直接从on-wire字节里按MsgIDLen去切——那样切到的
+	// 只是密文/校验和的前几个字节，而不是明文msgID
+	plain := buf
+	if msgParser.DecodeFunc != nil {
+		decoded, derr := msgParser.DecodeFunc(buf)
+		release()
+		release = func() {}
+		if derr != nil {
+			return 0, nil, nil, derr
 		}
+		plain = decoded
 	}
-	// 检查长度
-	switch {
-	case msgLen > msgParser.MaxMessageLen:
-		return nil, errors.New("message too long")
-	case msgLen < msgParser.MinMessageLen:
-		return nil, errors.New("message too short")
+	if uint32(len(plain)) < uint32(msgParser.MsgIDLen) {
+		release()
+		return 0, nil, nil, errors.New("message too short")
 	}
-	// 这里才是真正获取消息体
-	msgData := make([]byte, msgLen)
-	if _, err := io.ReadFull(conn, msgData); err != nil {
-		return nil, err
+	msgID = uint16(msgParser.readUint(plain[:msgParser.MsgIDLen], msgParser.MsgIDLen))
+	body = plain[msgParser.MsgIDLen:]
+	// 检查长度，针对的是明文长度，防止zip-bomb式攻击
+	switch {
+	case uint32(len(body)) > msgParser.MaxMessageLen:
+		release()
+		return 0, nil, nil, errors.New("message too long")
+	case uint32(len(body)) < msgParser.MinMessageLen:
+		release()
+		return 0, nil, nil, errors.New("message too short")
 	}
-	return msgData, nil
+	return msgID, body, release, nil
 }
 
 // 写数据
 // 由于参数是数组的数组，所以要注意调用时，不能有携程正在改变参数
-func (msgParser *MessageParser) Write(conn *Conn, args ...[]byte) error {
+func (msgParser *MessageParser) Write(conn *Conn, msgID uint16, args ...[]byte) error {
 	// 获取数据长度
-	var msgLen uint32
+	var bodyLen uint32
 	for _, value := range args {
-		msgLen += uint32(len(value))
+		bodyLen += uint32(len(value))
 	}
-	// 检查长度
+	// 检查长度，针对的是编码前的明文长度
 	switch {
-	case msgLen > msgParser.MaxMessageLen:
+	case bodyLen > msgParser.MaxMessageLen:
 		return errors.New("message too long")
-	case msgLen < msgParser.MinMessageLen:
+	case bodyLen < msgParser.MinMessageLen:
 		return errors.New("message too short")
 	}
-	msg := make([]byte, uint32(msgParser.MessageLen)+msgLen)
-	// 先写入消息体的长度数据
-	switch msgParser.MessageLen {
-	case 1:
-		msg[0] = byte(msgLen)
-	case 2:
-		if msgParser.LittleEndian {
-			binary.LittleEndian.PutUint16(msg, uint16(msgLen))
-		} else {
-			binary.BigEndian.PutUint16(msg, uint16(msgLen))
-		}
-	case 4:
-		if msgParser.LittleEndian {
-			binary.LittleEndian.PutUint32(msg, msgLen)
-		} else {
-			binary.BigEndian.PutUint32(msg, msgLen)
-		}
+	body := make([]byte, msgParser.MsgIDLen, uint32(msgParser.MsgIDLen)+bodyLen)
+	msgParser.writeUint(body[:msgParser.MsgIDLen], msgParser.MsgIDLen, uint32(msgID))
+	for _, value := range args {
+		body = append(body, value...)
 	}
-	length := msgParser.MessageLen
-	for i := 0; i < len(args); i++ {
-		copy(msg[length:], args[i])
-		length += len(args[i])
+	// 编码（加密/压缩/加校验等），len字段最终写入的是编码后（on-wire）的长度
+	if msgParser.EncodeFunc != nil {
+		var err error
+		body, err = msgParser.EncodeFunc(body)
+		if err != nil {
+			return err
+		}
 	}
+	msg := make([]byte, uint32(msgParser.MessageLen)+uint32(len(body)))
+	msgParser.writeUint(msg, msgParser.MessageLen, uint32(len(body)))
+	copy(msg[msgParser.MessageLen:], body)
 	conn.Write(msg)
 	return nil
 }
 
 // ws读取消息
-// 通过len将id+message读取出来
-func (msgParser *MessageParser) ReadWs(wsConn *WsConn) ([]byte, error) {
+// 通过len将msgID+message读取出来
+func (msgParser *MessageParser) ReadWs(wsConn *WsConn) (msgID uint16, body []byte, err error) {
 	_, data, err := wsConn.Conn.ReadMessage()
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
-	// 先获取id+msg的长度
-	bufMsgLen := data[:msgParser.MessageLen]
-	// 解析长度数据
-	var msgLen uint32
-	switch msgParser.MessageLen {
-	// 单字节不需要处理大小端模式
-	case 1:
-		msgLen = uint32(bufMsgLen[0])
-	// 多字节需要处理大小端模式
-	case 2:
-		if msgParser.LittleEndian {
-			msgLen = uint32(binary.LittleEndian.Uint16(bufMsgLen))
-		} else {
-			msgLen = uint32(binary.BigEndian.Uint16(bufMsgLen))
-		}
-	case 4:
-		if msgParser.LittleEndian {
-			msgLen = binary.LittleEndian.Uint32(bufMsgLen)
-		} else {
-			msgLen = binary.BigEndian.Uint32(bufMsgLen)
+	if len(data) < msgParser.MessageLen {
+		return 0, nil, errors.New("message too short")
+	}
+	// websocket本身就是消息边界清晰的帧，len字段在这里只是保持协议格式一致，无需解析
+	plain := data[msgParser.MessageLen:]
+	// WriteWs把msgID和body拼在一起后整体交给EncodeFunc编码，所以这里也要整体
+	// 解码之后才能切出msgID，不能直接从on-wire字节里按MsgIDLen去切
+	if msgParser.DecodeFunc != nil {
+		plain, err = msgParser.DecodeFunc(plain)
+		if err != nil {
+			return 0, nil, err
 		}
 	}
-	// 检查长度
+	if len(plain) < msgParser.MsgIDLen {
+		return 0, nil, errors.New("message too short")
+	}
+	msgID = uint16(msgParser.readUint(plain[:msgParser.MsgIDLen], msgParser.MsgIDLen))
+	body = plain[msgParser.MsgIDLen:]
+	// 检查长度，针对的是明文长度，防止zip-bomb式攻击
 	switch {
-	case msgLen > msgParser.MaxMessageLen:
-		return nil, errors.New("message too long")
-	case msgLen < msgParser.MinMessageLen:
-		return nil, errors.New("message too short")
+	case uint32(len(body)) > msgParser.MaxMessageLen:
+		return 0, nil, errors.New("message too long")
+	case uint32(len(body)) < msgParser.MinMessageLen:
+		return 0, nil, errors.New("message too short")
 	}
-	return data[msgParser.MessageLen:], nil
+	return msgID, body, nil
 }
 
 // 写数据
 // 由于参数是数组的数组，所以要注意调用时，不能有携程正在改变参数
-func (msgParser *MessageParser) WriteWs(wsConn *WsConn, args ...[]byte) error {
+func (msgParser *MessageParser) WriteWs(wsConn *WsConn, msgID uint16, args ...[]byte) error {
 	// 获取数据长度
-	var msgLen uint32
+	var bodyLen uint32
 	for _, value := range args {
-		msgLen += uint32(len(value))
+		bodyLen += uint32(len(value))
 	}
-	// 检查长度
+	// 检查长度，针对的是编码前的明文长度
 	switch {
-	case msgLen > msgParser.MaxMessageLen:
+	case bodyLen > msgParser.MaxMessageLen:
 		return errors.New("message too long")
-	case msgLen < msgParser.MinMessageLen:
+	case bodyLen < msgParser.MinMessageLen:
 		return errors.New("message too short")
 	}
-	// 完整的数据
-	msg := make([]byte, uint32(msgParser.MessageLen)+msgLen)
-	// 先写入消息体的长度数据
-	switch msgParser.MessageLen {
-	case 1:
-		msg[0] = byte(msgLen)
-	case 2:
-		if msgParser.LittleEndian {
-			binary.LittleEndian.PutUint16(msg, uint16(msgLen))
-		} else {
-			binary.BigEndian.PutUint16(msg, uint16(msgLen))
-		}
-	case 4:
-		if msgParser.LittleEndian {
-			binary.LittleEndian.PutUint32(msg, msgLen)
-		} else {
-			binary.BigEndian.PutUint32(msg, msgLen)
-		}
+	body := make([]byte, msgParser.MsgIDLen, uint32(msgParser.MsgIDLen)+bodyLen)
+	msgParser.writeUint(body[:msgParser.MsgIDLen], msgParser.MsgIDLen, uint32(msgID))
+	for _, value := range args {
+		body = append(body, value...)
 	}
-	length := msgParser.MessageLen
-	for i := 0; i < len(args); i++ {
-		copy(msg[length:], args[i])
-		length += len(args[i])
+	// 编码（加密/压缩/加校验等），len字段最终写入的是编码后（on-wire）的长度
+	if msgParser.EncodeFunc != nil {
+		var err error
+		body, err = msgParser.EncodeFunc(body)
+		if err != nil {
+			return err
+		}
 	}
+	// 完整的数据
+	msg := make([]byte, uint32(msgParser.MessageLen)+uint32(len(body)))
+	msgParser.writeUint(msg, msgParser.MessageLen, uint32(len(body)))
+	copy(msg[msgParser.MessageLen:], body)
 	wsConn.Write(msg)
 	return nil
 }
@@ -0,0 +1,224 @@
+// 分片消息重组队列
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	当一条逻辑消息超过 MessageParser 单帧大小限制（MaxMessageLen）时，
+	MessageQueue 负责把它切成若干分片发送，并在接收端重新拼接还原。
+
+	MessageParser的wire msgID是给Router按"消息类型"分发用的，MessageQueue
+	不能据为己用，否则分片消息就没法再按类型路由。因此每个分片仍然通过
+	MessageParser以普通消息的形式收发，固定使用这个队列专属的fragmentMsgID
+	这一个类型（哨兵值按parser.MsgIDLen算，避免MsgIDLen=1时wire上被截断后
+	Read读回的msgID跟哨兵值对不上的情况），真正标识"属于哪条逻辑消息"的分组号連同分片
+	信息一起放在消息体最前面：
+	-----------------------------------------
+	| msgID(2) | fragIndex(2) | more(1) | chunk |
+	-----------------------------------------
+	msgID 在发送端单调递增，用来区分同时在途的多条逻辑消息；
+	more 为 1 表示后面还有分片，为 0 表示这是最后一片。
+*/
+
+// defaultFragmentMsgID 是MsgIDLen>=2时使用的哨兵值，业务通过Router注册
+// 处理函数时不应该再使用这个类型值
+const defaultFragmentMsgID uint16 = 0xFFFF
+
+const fragHeaderLen = 5
+
+// 重组中的一条逻辑消息
+type pendingMsg struct {
+	mu     sync.Mutex
+	chunks map[uint16][]byte
+	total  uint16 // 收到 more=0 的分片后才知道总分片数，0表示未知
+	timer  *time.Timer
+}
+
+// MessageQueue 在 MessageParser 之上提供大消息的分片发送与重组
+type MessageQueue struct {
+	parser      *MessageParser
+	fragmentLen int           // 每个分片携带的最大数据长度
+	timeout     time.Duration // 一条消息的分片停留多久未凑齐就被丢弃
+
+	// fragmentMsgID是分片专用的wire msgID哨兵值，按parser.MsgIDLen算：
+	// MsgIDLen=1时wire上只有一个字节，defaultFragmentMsgID(0xFFFF)写出去
+	// 会被截成0xFF，Read重建出来的wireID却还是0x00FF，两者永远对不上，
+	// 分片消息就会被当成"不是分片"一直丢弃、永远重组不出结果
+	fragmentMsgID uint16
+
+	nextMsgID uint32
+
+	pending sync.Map // uint16 -> *pendingMsg
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewMessageQueue 构建一个分片重组队列
+// fragmentLen 加上分片头(fragHeaderLen字节)不能超过 parser.MaxMessageLen，
+// 否则 parser.Write 会拒绝发送；timeout 为单条消息的重组超时时间
+func NewMessageQueue(parser *MessageParser, fragmentLen int, timeout time.Duration) *MessageQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	fragmentMsgID := defaultFragmentMsgID
+	if parser != nil && parser.MsgIDLen == 1 {
+		fragmentMsgID = 0xFF
+	}
+	return &MessageQueue{
+		parser:        parser,
+		fragmentLen:   fragmentLen,
+		timeout:       timeout,
+		fragmentMsgID: fragmentMsgID,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// Close 取消所有正在重组的消息，并取消队列的ctx。已经阻塞在底层连接读取上的
+// Read/ReadWs 不会被Close唤醒，它们只在处理完一个分片之后才检查ctx
+func (mq *MessageQueue) Close() {
+	mq.cancel()
+	mq.pending.Range(func(key, value interface{}) bool {
+		value.(*pendingMsg).timer.Stop()
+		mq.pending.Delete(key)
+		return true
+	})
+}
+
+// Send 将 data 按 fragmentLen 切分为若干分片，通过 conn 依次发送
+func (mq *MessageQueue) Send(conn *Conn, data []byte) error {
+	return mq.send(data, func(frame []byte) error {
+		return mq.parser.Write(conn, mq.fragmentMsgID, frame)
+	})
+}
+
+// SendWs 与 Send 相同，只是通过 websocket 连接发送
+func (mq *MessageQueue) SendWs(wsConn *WsConn, data []byte) error {
+	return mq.send(data, func(frame []byte) error {
+		return mq.parser.WriteWs(wsConn, mq.fragmentMsgID, frame)
+	})
+}
+
+func (mq *MessageQueue) send(data []byte, write func(frame []byte) error) error {
+	id := uint16(atomic.AddUint32(&mq.nextMsgID, 1))
+	total := (len(data) + mq.fragmentLen - 1) / mq.fragmentLen
+	if total == 0 {
+		total = 1
+	}
+	for i := 0; i < total; i++ {
+		start := i * mq.fragmentLen
+		end := start + mq.fragmentLen
+		if end > len(data) {
+			end = len(data)
+		}
+		frame := make([]byte, fragHeaderLen+end-start)
+		binary.BigEndian.PutUint16(frame, id)
+		binary.BigEndian.PutUint16(frame[2:], uint16(i))
+		if i == total-1 {
+			frame[4] = 0
+		} else {
+			frame[4] = 1
+		}
+		copy(frame[fragHeaderLen:], data[start:end])
+		if err := write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read 从 conn 中读取分片并重组，直到凑齐一条完整消息或发生错误才返回。
+// 要求conn上的流量全部经由MessageQueue收发（或者至少，非分片消息不会
+// 跟分片专用的fragmentMsgID撞车），否则请改用Router按msgID分流后再转给feed。
+func (mq *MessageQueue) Read(conn *Conn) ([]byte, error) {
+	for {
+		wireID, raw, release, err := mq.parser.Read(conn)
+		if err != nil {
+			return nil, err
+		}
+		if wireID != mq.fragmentMsgID {
+			release()
+			continue
+		}
+		msg := mq.feed(raw)
+		release()
+		if msg != nil {
+			return msg, nil
+		}
+		select {
+		case <-mq.ctx.Done():
+			return nil, mq.ctx.Err()
+		default:
+		}
+	}
+}
+
+// ReadWs 与 Read 相同，只是从 websocket 连接读取分片
+func (mq *MessageQueue) ReadWs(wsConn *WsConn) ([]byte, error) {
+	for {
+		wireID, raw, err := mq.parser.ReadWs(wsConn)
+		if err != nil {
+			return nil, err
+		}
+		if wireID != mq.fragmentMsgID {
+			continue
+		}
+		if msg := mq.feed(raw); msg != nil {
+			return msg, nil
+		}
+		select {
+		case <-mq.ctx.Done():
+			return nil, mq.ctx.Err()
+		default:
+		}
+	}
+}
+
+// feed 把一个分片喂给重组队列，凑齐后返回完整消息，否则返回 nil
+func (mq *MessageQueue) feed(raw []byte) []byte {
+	if len(raw) < fragHeaderLen {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(raw)
+	frag := binary.BigEndian.Uint16(raw[2:])
+	more := raw[4] != 0
+	chunk := append([]byte(nil), raw[fragHeaderLen:]...)
+
+	value, _ := mq.pending.LoadOrStore(id, mq.newPendingMsg(id))
+	pm := value.(*pendingMsg)
+
+	pm.mu.Lock()
+	pm.chunks[frag] = chunk
+	if !more {
+		pm.total = frag + 1
+	}
+	done := pm.total != 0 && uint16(len(pm.chunks)) == pm.total
+	var result []byte
+	if done {
+		result = make([]byte, 0)
+		for i := uint16(0); i < pm.total; i++ {
+			result = append(result, pm.chunks[i]...)
+		}
+	}
+	pm.mu.Unlock()
+
+	if done {
+		pm.timer.Stop()
+		mq.pending.Delete(id)
+	}
+	return result
+}
+
+// newPendingMsg 创建一条待重组消息的记录，并安排超时清理
+func (mq *MessageQueue) newPendingMsg(id uint16) *pendingMsg {
+	pm := &pendingMsg{chunks: make(map[uint16][]byte)}
+	pm.timer = time.AfterFunc(mq.timeout, func() {
+		mq.pending.Delete(id)
+	})
+	return pm
+}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func buildFragment(id, frag uint16, more bool, chunk []byte) []byte {
+	frame := make([]byte, fragHeaderLen+len(chunk))
+	binary.BigEndian.PutUint16(frame, id)
+	binary.BigEndian.PutUint16(frame[2:], frag)
+	if more {
+		frame[4] = 1
+	}
+	copy(frame[fragHeaderLen:], chunk)
+	return frame
+}
+
+func TestMessageQueueFeedReassemblesInOrder(t *testing.T) {
+	mq := NewMessageQueue(nil, 4, time.Second)
+
+	if msg := mq.feed(buildFragment(1, 0, true, []byte("ab"))); msg != nil {
+		t.Fatalf("expected nil before last fragment, got %v", msg)
+	}
+	msg := mq.feed(buildFragment(1, 1, false, []byte("cd")))
+	if string(msg) != "abcd" {
+		t.Fatalf("got %q, want %q", msg, "abcd")
+	}
+}
+
+func TestMessageQueueFeedReassemblesOutOfOrder(t *testing.T) {
+	mq := NewMessageQueue(nil, 4, time.Second)
+
+	if msg := mq.feed(buildFragment(2, 1, false, []byte("cd"))); msg != nil {
+		t.Fatalf("expected nil before all fragments arrive, got %v", msg)
+	}
+	msg := mq.feed(buildFragment(2, 0, true, []byte("ab")))
+	if string(msg) != "abcd" {
+		t.Fatalf("got %q, want %q", msg, "abcd")
+	}
+}
+
+func TestMessageQueueFeedTracksIndependentMessages(t *testing.T) {
+	mq := NewMessageQueue(nil, 4, time.Second)
+
+	mq.feed(buildFragment(1, 0, true, []byte("a")))
+	mq.feed(buildFragment(2, 0, true, []byte("x")))
+	msg1 := mq.feed(buildFragment(1, 1, false, []byte("b")))
+	msg2 := mq.feed(buildFragment(2, 1, false, []byte("y")))
+
+	if string(msg1) != "ab" {
+		t.Fatalf("msg1 = %q, want %q", msg1, "ab")
+	}
+	if string(msg2) != "xy" {
+		t.Fatalf("msg2 = %q, want %q", msg2, "xy")
+	}
+}
+
+func TestMessageQueuePurgesStaleFragmentsAfterTimeout(t *testing.T) {
+	mq := NewMessageQueue(nil, 4, 30*time.Millisecond)
+
+	if msg := mq.feed(buildFragment(3, 0, true, []byte("a"))); msg != nil {
+		t.Fatalf("expected nil for a partial message, got %v", msg)
+	}
+	if _, ok := mq.pending.Load(uint16(3)); !ok {
+		t.Fatal("expected the half-received message to be pending")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, ok := mq.pending.Load(uint16(3)); ok {
+		t.Fatal("expected the stale pending message to be purged after its timeout")
+	}
+}
+
+func TestMessageQueueClosePurgesPending(t *testing.T) {
+	mq := NewMessageQueue(nil, 4, time.Minute)
+
+	mq.feed(buildFragment(4, 0, true, []byte("a")))
+	if _, ok := mq.pending.Load(uint16(4)); !ok {
+		t.Fatal("expected the half-received message to be pending")
+	}
+
+	mq.Close()
+
+	if _, ok := mq.pending.Load(uint16(4)); ok {
+		t.Fatal("expected Close to purge all pending reassembly state")
+	}
+	select {
+	case <-mq.ctx.Done():
+	default:
+		t.Fatal("expected Close to cancel the queue's context")
+	}
+}
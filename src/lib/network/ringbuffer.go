@@ -0,0 +1,135 @@
+// 定长环形字节缓冲区
+package network
+
+import (
+	"io"
+	"sync"
+)
+
+/*
+	RingBuffer 把"从socket读字节"和"从字节里切出完整帧"这两件事解耦：
+	负责收socket的协程不断调用Write往里灌数据，解析协程通过Peek/ReadFrame
+	取数据。容量固定，写满之后Write会阻塞，从而为上层提供背压，
+	可以用来对付那些一次只发几个字节的慢速连接。
+*/
+type RingBuffer struct {
+	buf   []byte
+	r, w  int // 读/写游标，取值范围 [0, len(buf))
+	count int // 缓冲区中尚未被读走的字节数
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	closed   bool
+}
+
+// NewRingBuffer 创建一个容量固定为capacity字节的环形缓冲区
+func NewRingBuffer(capacity int) *RingBuffer {
+	rb := &RingBuffer{buf: make([]byte, capacity)}
+	rb.notEmpty = sync.NewCond(&rb.mu)
+	rb.notFull = sync.NewCond(&rb.mu)
+	return rb
+}
+
+// Cap 返回缓冲区的固定容量，调用方可以据此判断一帧是否塞得下
+func (rb *RingBuffer) Cap() int {
+	return len(rb.buf)
+}
+
+// Write 向缓冲区追加数据，空间不足时阻塞直到被读出足够空间或Close
+func (rb *RingBuffer) Write(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		if rb.closed {
+			return n, io.ErrClosedPipe
+		}
+		for rb.count == len(rb.buf) && !rb.closed {
+			rb.notFull.Wait()
+		}
+		if rb.closed {
+			return n, io.ErrClosedPipe
+		}
+		free := len(rb.buf) - rb.count
+		chunk := len(p) - n
+		if chunk > free {
+			chunk = free
+		}
+		for i := 0; i < chunk; i++ {
+			rb.buf[rb.w] = p[n+i]
+			rb.w = (rb.w + 1) % len(rb.buf)
+		}
+		rb.count += chunk
+		n += chunk
+		rb.notEmpty.Broadcast()
+	}
+	return n, nil
+}
+
+// Peek 在不消费数据的前提下查看接下来的n个字节，不足n个时阻塞直到凑够或Close
+func (rb *RingBuffer) Peek(n int) ([]byte, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for rb.count < n && !rb.closed {
+		rb.notEmpty.Wait()
+	}
+	if rb.count < n {
+		return nil, io.EOF
+	}
+	out := make([]byte, n)
+	for i := 0; i < n; i++ {
+		out[i] = rb.buf[(rb.r+i)%len(rb.buf)]
+	}
+	return out, nil
+}
+
+// Discard 丢弃已经消费过的n个字节，n超过当前可读字节数时按可读字节数截断
+func (rb *RingBuffer) Discard(n int) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if n > rb.count {
+		n = rb.count
+	}
+	rb.r = (rb.r + n) % len(rb.buf)
+	rb.count -= n
+	rb.notFull.Broadcast()
+}
+
+// ReadFrame 读取定长的n个字节并作为一帧返回，不足n个时阻塞直到凑够或Close。
+// 当这n个字节在缓冲区里连续（没有跨越回绕点）时，返回的切片直接别名到
+// 底层数组，不发生拷贝；跨越回绕点时才退化为一次拷贝。
+// 调用方必须在下一次Write可能覆盖这段数据之前用完返回的切片。
+func (rb *RingBuffer) ReadFrame(n int) ([]byte, error) {
+	rb.mu.Lock()
+	for rb.count < n && !rb.closed {
+		rb.notEmpty.Wait()
+	}
+	if rb.count < n {
+		rb.mu.Unlock()
+		return nil, io.EOF
+	}
+	var frame []byte
+	if rb.r+n <= len(rb.buf) {
+		frame = rb.buf[rb.r : rb.r+n]
+	} else {
+		frame = make([]byte, n)
+		for i := 0; i < n; i++ {
+			frame[i] = rb.buf[(rb.r+i)%len(rb.buf)]
+		}
+	}
+	rb.r = (rb.r + n) % len(rb.buf)
+	rb.count -= n
+	rb.mu.Unlock()
+	rb.notFull.Broadcast()
+	return frame, nil
+}
+
+// Close 标记流结束，唤醒所有阻塞在 Write/Peek/ReadFrame 上的调用
+func (rb *RingBuffer) Close() {
+	rb.mu.Lock()
+	rb.closed = true
+	rb.mu.Unlock()
+	rb.notEmpty.Broadcast()
+	rb.notFull.Broadcast()
+}
@@ -0,0 +1,150 @@
+package network
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRingBufferReadFrameAliasesUntilWrap(t *testing.T) {
+	rb := NewRingBuffer(8)
+	if _, err := rb.Write([]byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	frame, err := rb.ReadFrame(4)
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if string(frame) != string([]byte{1, 2, 3, 4}) {
+		t.Fatalf("got %v, want [1 2 3 4]", frame)
+	}
+	// 这一帧没有跨越回绕点，应当直接别名到底层数组
+	if &frame[0] != &rb.buf[0] {
+		t.Fatal("expected ReadFrame to alias the ring's backing array for a non-wrapping frame")
+	}
+}
+
+func TestRingBufferWrapAround(t *testing.T) {
+	rb := NewRingBuffer(4)
+	if _, err := rb.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := rb.ReadFrame(2); err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	// 这次写入会让游标绕回缓冲区开头
+	if _, err := rb.Write([]byte{4, 5}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	frame, err := rb.ReadFrame(3)
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if string(frame) != string([]byte{3, 4, 5}) {
+		t.Fatalf("got %v, want [3 4 5]", frame)
+	}
+}
+
+func TestRingBufferPeekDoesNotConsume(t *testing.T) {
+	rb := NewRingBuffer(8)
+	if _, err := rb.Write([]byte{9, 9, 9}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := rb.Peek(2); err != nil {
+		t.Fatalf("Peek: %v", err)
+	}
+	frame, err := rb.ReadFrame(3)
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if len(frame) != 3 {
+		t.Fatalf("Peek should not have consumed bytes, got frame len %d", len(frame))
+	}
+}
+
+func TestRingBufferReadFrameBlocksUntilFed(t *testing.T) {
+	rb := NewRingBuffer(8)
+	done := make(chan []byte, 1)
+	go func() {
+		frame, err := rb.ReadFrame(5)
+		if err != nil {
+			done <- nil
+			return
+		}
+		done <- frame
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("ReadFrame returned before enough data was written")
+	default:
+	}
+
+	if _, err := rb.Write([]byte{1, 2, 3, 4, 5}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	select {
+	case frame := <-done:
+		if string(frame) != string([]byte{1, 2, 3, 4, 5}) {
+			t.Fatalf("got %v", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadFrame did not unblock after Write")
+	}
+}
+
+func TestRingBufferCloseWakesBlockedReaders(t *testing.T) {
+	rb := NewRingBuffer(8)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := rb.ReadFrame(100) // 永远凑不够，只能靠Close唤醒
+		errCh <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	rb.Close()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("expected an error after Close, got nil")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not wake the blocked ReadFrame")
+	}
+}
+
+func TestRingBufferBackpressure(t *testing.T) {
+	rb := NewRingBuffer(4)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	writeDone := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		// 缓冲区只有4字节，这次写入必须等读者腾出空间才能完成
+		if _, err := rb.Write([]byte{1, 2, 3, 4, 5, 6}); err != nil {
+			t.Errorf("Write: %v", err)
+		}
+		close(writeDone)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-writeDone:
+		t.Fatal("Write should have blocked once the ring filled up")
+	default:
+	}
+
+	if _, err := rb.ReadFrame(4); err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+
+	select {
+	case <-writeDone:
+	case <-time.After(time.Second):
+		t.Fatal("Write did not unblock after space was freed")
+	}
+	wg.Wait()
+}
@@ -0,0 +1,28 @@
+// 基于msgID的请求分发
+package network
+
+// HandlerFunc 处理一个已经按msgID分发到的消息体
+type HandlerFunc func(conn *Conn, body []byte)
+
+// Router 把 MessageParser.Read 解出的msgID映射到具体的处理函数，
+// 省去调用方手动从消息体里切出id的约定
+type Router struct {
+	handlers map[uint16]HandlerFunc
+}
+
+// NewRouter 构建一个空的路由表
+func NewRouter() *Router {
+	return &Router{handlers: make(map[uint16]HandlerFunc)}
+}
+
+// Handle 注册msgID对应的处理函数，重复注册会覆盖旧的
+func (router *Router) Handle(msgID uint16, handler HandlerFunc) {
+	router.handlers[msgID] = handler
+}
+
+// Dispatch 按msgID查找处理函数并调用，找不到则静默忽略
+func (router *Router) Dispatch(conn *Conn, msgID uint16, body []byte) {
+	if handler, ok := router.handlers[msgID]; ok {
+		handler(conn, body)
+	}
+}